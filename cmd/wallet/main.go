@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+//Command wallet is the wallet's CLI entry point.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/monarj/wallet/tx"
+	"github.com/monarj/wallet/tx/bip276"
+	"github.com/monarj/wallet/wallet/api"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: wallet <verb> [args]")
+		os.Exit(1)
+	}
+	var err error
+	switch os.Args[1] {
+	case "export-script":
+		err = exportScript(os.Args[2:])
+	case "serve":
+		err = serve(os.Args[2:])
+	case "migrate-coins":
+		err = tx.MigrateCoinsToBinary()
+	default:
+		err = fmt.Errorf("unknown verb %s", os.Args[1])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+//serve implements "wallet serve", starting wallet/api's read-only query
+//endpoints over HTTP.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8332", "address to listen on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return api.Start(*addr)
+}
+
+//exportScript implements "wallet export-script", printing a redeem (or
+//other) script as a BIP-276 typed string so it can be shared for a
+//multisig ceremony. The script comes either from -script directly, or,
+//via -script-hash, from a redeem script previously saved by
+//tx.SaveRedeemScript (e.g. when a P2SH multisig address was created).
+func exportScript(args []string) error {
+	fs := flag.NewFlagSet("export-script", flag.ExitOnError)
+	script := fs.String("script", "", "hex encoded script")
+	scriptHash := fs.String("script-hash", "", "hex encoded hash of a previously saved redeem script")
+	prefix := fs.String("prefix", "bitcoin-script", "BIP-276 prefix")
+	network := fs.Int("network", 0, "network id")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var raw []byte
+	switch {
+	case *script != "":
+		var err error
+		raw, err = hex.DecodeString(*script)
+		if err != nil {
+			return err
+		}
+	case *scriptHash != "":
+		hash, err := hex.DecodeString(*scriptHash)
+		if err != nil {
+			return err
+		}
+		raw, err = tx.GetRedeemScript(hash)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("export-script: one of -script or -script-hash is required")
+	}
+	str, err := bip276.Encode(*prefix, *network, raw)
+	if err != nil {
+		return err
+	}
+	fmt.Println(str)
+	return nil
+}
@@ -49,9 +49,13 @@ lastblock height hash
 block hash (height,prev)
 blockheight height hash
 key pub priv
-coin hash json(Coin)
+coin <hash index> bin(Coin)
 spend <hash index>,hash
 scripthash hash hash
+psbt hash b64(psbt)
+pool hash msg(tx)
+redeem scripthash script
+status "schemaVersion" int
 */
 
 //DB is bolt.DB for operating database.
@@ -66,8 +70,24 @@ func init() {
 	}
 }
 
+//Marshaler is implemented by types that have a compact, fixed-layout
+//on-disk representation, typically backed by msg.Pack. Tob/Put prefer it
+//over the json.Marshal fallback.
+type Marshaler interface {
+	MarshalDB() ([]byte, error)
+}
+
+//Unmarshaler is the read-side counterpart of Marshaler. B2v/Get prefer it
+//over the json.Unmarshal fallback.
+type Unmarshaler interface {
+	UnmarshalDB([]byte) error
+}
+
 // Tob returns an 8-byte big endian representation of v.
 func Tob(v interface{}) ([]byte, error) {
+	if m, ok := v.(Marshaler); ok {
+		return m.MarshalDB()
+	}
 	switch t := v.(type) {
 	case []byte:
 		return t, nil
@@ -114,6 +134,9 @@ func ToKey(v ...interface{}) []byte {
 
 //B2v converts from 'from' to 'to' according to 'to' type.
 func B2v(from []byte, to interface{}) error {
+	if u, ok := to.(Unmarshaler); ok {
+		return u.UnmarshalDB(from)
+	}
 	var err error
 	switch t := to.(type) {
 	case *string:
@@ -315,3 +338,72 @@ func Batch(bucket string, key []byte, value interface{}) error {
 		return Put(tx, bucket, key, value)
 	})
 }
+
+//PutM puts a value that implements Marshaler, using its compact on-disk
+//representation. Unlike Put, it only accepts a Marshaler, so it never
+//falls back to json.Marshal.
+func PutM(tx *bolt.Tx, bucket string, key []byte, value Marshaler) error {
+	val, err := value.MarshalDB()
+	if err != nil {
+		return err
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return fmt.Errorf("create bucket: %s", err)
+	}
+	return b.Put(key, val)
+}
+
+//GetM gets a value that implements Unmarshaler. Unlike Get, it only
+//accepts an Unmarshaler, so it never falls back to json.Unmarshal.
+func GetM(tx *bolt.Tx, bucket string, key []byte, value Unmarshaler) ([]byte, error) {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil, errors.New("bucket not found " + bucket)
+	}
+	v := b.Get(key)
+	if v == nil {
+		return nil, errors.New("key not found")
+	}
+	return v, value.UnmarshalDB(v)
+}
+
+//statusBucket holds wallet-wide metadata such as schemaVersion.
+const statusBucket = "status"
+
+//schemaVersionKey is the status bucket key MigrateToBinary stamps once a
+//bucket has been migrated off JSON.
+const schemaVersionKey = "schemaVersion"
+
+//MigrateToBinary walks every entry of bucket, decodes its (presumably
+//JSON) value with decode into a Marshaler, and rewrites it using
+//MarshalDB's compact binary form. It then stamps schemaVersion under the
+//status bucket, so callers can make this a one-shot operation by checking
+//it first.
+func MigrateToBinary(bucket string, decode func(raw []byte) (Marshaler, error)) error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			m, err := decode(v)
+			if err != nil {
+				return fmt.Errorf("migrate %s/%x: %s", bucket, k, err)
+			}
+			val, err := m.MarshalDB()
+			if err != nil {
+				return err
+			}
+			if err := b.Put(k, val); err != nil {
+				return err
+			}
+		}
+		return Put(tx, statusBucket, []byte(schemaVersionKey), schemaVersion)
+	})
+}
+
+//schemaVersion is stamped into the status bucket once MigrateToBinary has
+//run against the current set of buckets.
+const schemaVersion = 1
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+//Package bip276 encodes and decodes the typed string format described by
+//BIP-276, so scripts this wallet understands can be shared as a single
+//copy-pasteable string instead of raw hex.
+package bip276
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/monarj/wallet/msg"
+)
+
+//version is the BIP-276 format version this package produces.
+const version = 1
+
+//BIP276 is a parsed <prefix>:<version><network><payload><checksum> string.
+type BIP276 struct {
+	Prefix  string
+	Version int
+	Network int
+	Payload []byte
+}
+
+//checksum is the first 4 bytes of double-SHA256 of the string that precedes
+//it in the encoded form: "prefix:" + 2 hex digits of version + 2 hex digits
+//of network + the hex-encoded payload. It operates on that textual form,
+//not the raw bytes, so it matches exactly what Decode sees before the
+//checksum is stripped off.
+func checksum(prefix string, version, network int, payload []byte) []byte {
+	text := fmt.Sprintf("%s:%02x%02x%s", prefix, version, network, hex.EncodeToString(payload))
+	h1 := sha256.Sum256([]byte(text))
+	h2 := sha256.Sum256(h1[:])
+	return h2[:4]
+}
+
+//Encode wraps s in the BIP-276 typed string format. s is either raw script
+//bytes or one of the wallet's script structs (Script, Script2, Script3,
+//RedeemScript), serialized the same way the wire protocol does.
+func Encode(prefix string, network int, s interface{}) (string, error) {
+	var payload []byte
+	switch t := s.(type) {
+	case []byte:
+		payload = t
+	default:
+		buf := new(bytes.Buffer)
+		if err := msg.Pack(buf, s); err != nil {
+			return "", err
+		}
+		payload = buf.Bytes()
+	}
+	sum := checksum(prefix, version, network, payload)
+	return fmt.Sprintf("%s:%02x%02x%s%s", prefix, version, network, hex.EncodeToString(payload), hex.EncodeToString(sum)), nil
+}
+
+//Decode parses a BIP-276 string produced by Encode and verifies its checksum.
+func Decode(str string) (*BIP276, error) {
+	parts := strings.SplitN(str, ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("bip276: missing prefix")
+	}
+	prefix, body := parts[0], parts[1]
+	raw, err := hex.DecodeString(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 2+4 {
+		return nil, errors.New("bip276: too short")
+	}
+	ver := int(raw[0])
+	network := int(raw[1])
+	payload := raw[2 : len(raw)-4]
+	sum := raw[len(raw)-4:]
+	if !bytes.Equal(sum, checksum(prefix, ver, network, payload)) {
+		return nil, errors.New("bip276: bad checksum")
+	}
+	return &BIP276{Prefix: prefix, Version: ver, Network: network, Payload: payload}, nil
+}
@@ -0,0 +1,378 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/monarj/wallet/db"
+	"github.com/monarj/wallet/key"
+	"github.com/monarj/wallet/msg"
+)
+
+//poolBucket is where pending (unconfirmed) txs are kept so they survive a restart.
+const poolBucket = "pool"
+
+//spendBucket records which (hash,index) a confirmed tx has already spent.
+const spendBucket = "spend"
+
+//coinBucket is the on-disk counterpart of the in-memory coins map.
+const coinBucket = "coin"
+
+//staged holds the coin map changes a pooled tx would make once confirmed,
+//computed eagerly at Add() time so Commit doesn't have to reparse the tx.
+type staged struct {
+	adds    []*Coin
+	removes []spentCoin
+}
+
+type spentCoin struct {
+	pub   *key.PublicKey
+	hash  []byte
+	index uint32
+	//p2sh is true when this outpoint was spent via a P2SH multisig
+	//scriptsig, so Commit must remove it by hash/index (removeRedeem)
+	//rather than by owning pubkey (remove).
+	p2sh bool
+}
+
+//Pool buffers unconfirmed txs, rejecting double-spends against both other
+//pooled txs and already-confirmed coins, until a block confirms or evicts them.
+type Pool struct {
+	mutex   sync.RWMutex
+	pending map[string]*msg.Tx
+	spentBy map[string]string
+	staged  map[string]*staged
+	expires map[string]time.Time
+	ttl     time.Duration
+}
+
+//NewPool creates an empty Pool whose entries expire after ttl if never
+//confirmed or evicted. Call Load afterwards to restore txs a previous
+//run had pooled.
+func NewPool(ttl time.Duration) *Pool {
+	return &Pool{
+		pending: make(map[string]*msg.Tx),
+		spentBy: make(map[string]string),
+		staged:  make(map[string]*staged),
+		expires: make(map[string]time.Time),
+		ttl:     ttl,
+	}
+}
+
+func spentKey(hash []byte, index uint32) string {
+	return string(db.ToKey(hash, index))
+}
+
+func isSpent(hash []byte, index uint32) bool {
+	found := false
+	_ = db.DB.View(func(t *bolt.Tx) error {
+		v, err := db.Get(t, spendBucket, db.ToKey(hash, index), nil)
+		found = err == nil && v != nil
+		return nil
+	})
+	return found
+}
+
+//stageTx computes the coin map changes mtx would make once confirmed. It
+//mirrors Add()'s per-txin/txout recognition, including P2SH multisig, and
+//doesn't validate double-spends or touch a Pool, so Add and Load can both
+//use it to get identical staged results.
+func stageTx(mtx *msg.Tx) *staged {
+	st := &staged{}
+	for _, in := range mtx.TxIn {
+		zero := make([]byte, 32)
+		if bytes.Equal(in.Hash, zero) && in.Index == 0xffffffff {
+			continue
+		}
+		buf, err := parseScriptsigH(in.Script)
+		if err != nil {
+			if rs, _, perr := parseP2SHScriptsig(in.Script); perr == nil {
+				if verifyRedeemKeys(rs) == nil {
+					st.removes = append(st.removes, spentCoin{hash: in.Hash, index: in.Index, p2sh: true})
+				}
+			}
+			continue
+		}
+		s, err := parseScriptsigT(buf, in.Script)
+		if err != nil {
+			continue
+		}
+		pubkey, err := checkTxin(s)
+		if err != nil {
+			continue
+		}
+		st.removes = append(st.removes, spentCoin{pub: pubkey, hash: in.Hash, index: in.Index})
+	}
+
+	for i, out := range mtx.TxOut {
+		s := Script{}
+		err := parse(&s, out.Script)
+		s2 := Script2{}
+		err2 := parse(&s2, out.Script)
+		s3 := Script3{}
+		err4 := parse(&s3, out.Script)
+
+		var pubkey *key.PublicKey
+		var err3 error
+		var ttype int
+		switch {
+		case err == nil:
+			pubkey, err3 = checkTxout(&s)
+			ttype = 0
+		case err2 == nil:
+			pubkey, err3 = checkTxout2(&s2)
+			ttype = 1
+		case err4 == nil:
+			redeem, rerr := checkTxout3(&s3)
+			if rerr != nil {
+				continue
+			}
+			st.adds = append(st.adds, &Coin{
+				Addr:         s3.ScriptHash,
+				TxHash:       mtx.Hash(),
+				TxIndex:      uint32(i),
+				Value:        mtx.TxOut[i].Value,
+				Ttype:        2,
+				RedeemScript: redeem,
+			})
+			continue
+		default:
+			continue
+		}
+		if err3 != nil {
+			continue
+		}
+		st.adds = append(st.adds, &Coin{
+			Addr:    pubkey.Serialize(),
+			TxHash:  mtx.Hash(),
+			TxIndex: uint32(i),
+			Value:   mtx.TxOut[i].Value,
+			Ttype:   ttype,
+		})
+	}
+	return st
+}
+
+//register adds mtx's staged effects into the pool's in-memory bookkeeping.
+//Caller must hold mutex.
+func (p *Pool) register(txHash string, mtx *msg.Tx, st *staged) {
+	p.pending[txHash] = mtx
+	p.staged[txHash] = st
+	p.expires[txHash] = time.Now().Add(p.ttl)
+	for _, r := range st.removes {
+		p.spentBy[spentKey(r.hash, r.index)] = txHash
+	}
+}
+
+//checkDoubleSpendLocked rejects mtx if one of its inputs is already
+//claimed by another pooled tx or already spent per the spend bucket.
+//Caller must hold mutex.
+func (p *Pool) checkDoubleSpendLocked(mtx *msg.Tx, txHash string) error {
+	for _, in := range mtx.TxIn {
+		zero := make([]byte, 32)
+		if bytes.Equal(in.Hash, zero) && in.Index == 0xffffffff {
+			continue
+		}
+		sk := spentKey(in.Hash, in.Index)
+		if owner, ok := p.spentBy[sk]; ok && owner != txHash {
+			return fmt.Errorf("double spend of %x:%d by a pooled tx", in.Hash, in.Index)
+		}
+		if isSpent(in.Hash, in.Index) {
+			return fmt.Errorf("%x:%d is already spent", in.Hash, in.Index)
+		}
+	}
+	return nil
+}
+
+//Add validates mtx the same way Add() does and, if accepted, stages its
+//coin map changes and buffers the tx until Commit or Evict is called.
+func (p *Pool) Add(mtx *msg.Tx) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.expireLocked()
+
+	txHash := string(mtx.Hash())
+	if _, ok := p.pending[txHash]; ok {
+		return fmt.Errorf("tx %x is already pooled", mtx.Hash())
+	}
+	if err := p.checkDoubleSpendLocked(mtx, txHash); err != nil {
+		return err
+	}
+
+	p.register(txHash, mtx, stageTx(mtx))
+
+	buf := new(bytes.Buffer)
+	if err := msg.Pack(buf, mtx); err != nil {
+		return err
+	}
+	return db.Batch(poolBucket, mtx.Hash(), buf.Bytes())
+}
+
+//Load rebuilds pending/staged/spentBy from the pool bucket, restoring the
+//txs a previous run had pooled. Call it once, right after NewPool.
+func (p *Pool) Load() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return db.DB.View(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(poolBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			mtx := &msg.Tx{}
+			if err := msg.Unpack(bytes.NewBuffer(v), mtx); err != nil {
+				return fmt.Errorf("pool: restoring %x: %s", k, err)
+			}
+			p.register(string(mtx.Hash()), mtx, stageTx(mtx))
+			return nil
+		})
+	})
+}
+
+//Commit promotes the staged effects of the tx identified by txHash into the
+//real coins map and the coin/spend buckets. It's called once a block
+//confirms the tx.
+func (p *Pool) Commit(txHash []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := string(txHash)
+	st, ok := p.staged[key]
+	if !ok {
+		return fmt.Errorf("tx %x is not pooled", txHash)
+	}
+
+	mutex.Lock()
+	for _, c := range st.adds {
+		coins[string(c.Addr)] = append(coins[string(c.Addr)], c)
+	}
+	mutex.Unlock()
+	for _, c := range st.adds {
+		if err := db.Batch(coinBucket, db.ToKey(c.TxHash, c.TxIndex), c); err != nil {
+			return err
+		}
+	}
+	for _, r := range st.removes {
+		var err error
+		if r.p2sh {
+			err = removeRedeem(r.hash, r.index)
+		} else {
+			err = remove(r.pub, r.hash, r.index)
+		}
+		if err != nil {
+			return err
+		}
+		if err := db.DB.Update(func(t *bolt.Tx) error {
+			if t.Bucket([]byte(coinBucket)) == nil {
+				return nil
+			}
+			return db.Del(t, coinBucket, db.ToKey(r.hash, r.index))
+		}); err != nil {
+			return err
+		}
+		if err := db.Batch(spendBucket, db.ToKey(r.hash, r.index), txHash); err != nil {
+			return err
+		}
+	}
+	p.cleanup(key)
+	return p.deleteFromBucket(txHash)
+}
+
+//Evict drops a pooled tx and rolls back its staged changes without ever
+//having touched the real coins map.
+func (p *Pool) Evict(txHash []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.cleanup(string(txHash))
+	return p.deleteFromBucket(txHash)
+}
+
+func (p *Pool) deleteFromBucket(txHash []byte) error {
+	return db.DB.Update(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(poolBucket))
+		if b == nil {
+			return nil
+		}
+		return db.Del(t, poolBucket, txHash)
+	})
+}
+
+//cleanup removes all bookkeeping for a pooled tx. Caller must hold mutex.
+func (p *Pool) cleanup(key string) {
+	if st, ok := p.staged[key]; ok {
+		for _, r := range st.removes {
+			delete(p.spentBy, spentKey(r.hash, r.index))
+		}
+	}
+	delete(p.pending, key)
+	delete(p.staged, key)
+	delete(p.expires, key)
+}
+
+//expireLocked evicts pooled txs older than ttl, both from memory and from
+//the pool bucket. Caller must hold mutex.
+func (p *Pool) expireLocked() {
+	now := time.Now()
+	var expired [][]byte
+	for key, exp := range p.expires {
+		if now.After(exp) {
+			expired = append(expired, []byte(key))
+		}
+	}
+	for _, hash := range expired {
+		p.cleanup(string(hash))
+		if err := p.deleteFromBucket(hash); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+//Pending sums the value a pubkey would gain from every currently pooled tx,
+//so callers can show unconfirmed balance separately from confirmed balance.
+func (p *Pool) Pending(pub *key.PublicKey) uint64 {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	a := pub.Serialize()
+	var total uint64
+	for _, st := range p.staged {
+		for _, c := range st.adds {
+			if bytes.Equal(c.Addr, a) {
+				total += c.Value
+			}
+		}
+	}
+	return total
+}
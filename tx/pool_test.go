@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/monarj/wallet/db"
+	"github.com/monarj/wallet/msg"
+)
+
+//TestMain opens a temporary bolt database so isSpent (used by
+//checkDoubleSpendLocked) has a real db.DB to query against.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "wallet-pool-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	db.DB, err = bolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer db.DB.Close()
+	os.Exit(m.Run())
+}
+
+func TestCheckDoubleSpendLockedRejectsSecondSpendOfSameOutpoint(t *testing.T) {
+	p := NewPool(time.Hour)
+	hash := []byte("outpoint-hash-one-222222222222222")
+
+	//tx1 stages spending hash:3 via a P2SH input, the same staging path
+	//a regular pubkey spend would go through except for the p2sh flag.
+	p.register("tx1", &msg.Tx{}, &staged{
+		removes: []spentCoin{{hash: hash, index: 3, p2sh: true}},
+	})
+
+	other := &msg.Tx{TxIn: []msg.TxIn{{Hash: hash, Index: 3}}}
+	if err := p.checkDoubleSpendLocked(other, "tx2"); err == nil {
+		t.Fatal("expected a second pooled tx spending the same outpoint to be rejected")
+	}
+}
+
+func TestCheckDoubleSpendLockedAllowsSameTxToRecheck(t *testing.T) {
+	p := NewPool(time.Hour)
+	hash := []byte("outpoint-hash-two-333333333333333")
+
+	p.register("tx1", &msg.Tx{}, &staged{
+		removes: []spentCoin{{hash: hash, index: 0}},
+	})
+
+	same := &msg.Tx{TxIn: []msg.TxIn{{Hash: hash, Index: 0}}}
+	if err := p.checkDoubleSpendLocked(same, "tx1"); err != nil {
+		t.Fatalf("a tx shouldn't be rejected as a double spend of its own staged outpoint: %s", err)
+	}
+}
+
+func TestCleanupFreesOutpointForReuse(t *testing.T) {
+	p := NewPool(time.Hour)
+	hash := []byte("outpoint-hash-three-44444444444444")
+
+	p.register("tx1", &msg.Tx{}, &staged{
+		removes: []spentCoin{{hash: hash, index: 0, p2sh: true}},
+	})
+	p.cleanup("tx1")
+
+	other := &msg.Tx{TxIn: []msg.TxIn{{Hash: hash, Index: 0}}}
+	if err := p.checkDoubleSpendLocked(other, "tx2"); err != nil {
+		t.Fatalf("outpoint should be free again once its staking tx is cleaned up: %s", err)
+	}
+}
@@ -0,0 +1,532 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+//Package psbt implements BIP-174 Partially Signed Bitcoin Transactions so
+//an offline wallet can play every role (Creator, Updater, Signer, Combiner,
+//Finalizer, Extractor) needed to co-sign a transaction across several
+//machines or peers.
+package psbt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/monarj/wallet/db"
+	"github.com/monarj/wallet/key"
+	"github.com/monarj/wallet/msg"
+	"github.com/monarj/wallet/tx"
+)
+
+//magic is the 5 byte PSBT magic defined by BIP-174.
+var magic = []byte{0x70, 0x73, 0x62, 0x74, 0xff}
+
+//Global, input and output key types this package understands.
+const (
+	globalUnsignedTx = 0x00
+
+	inNonWitnessUtxo = 0x00
+	inPartialSig     = 0x02
+	inRedeemScript   = 0x04
+
+	outRedeemScript = 0x00
+)
+
+//bucket is the bolt bucket in-flight PSBTs are kept in so a multisig
+//ceremony survives a restart.
+const bucket = "psbt"
+
+//Input carries everything the Updater/Signer/Combiner need about one
+//input of the unsigned tx.
+type Input struct {
+	//Coin is the wallet's record of the output being spent. This wallet
+	//doesn't keep full historical transactions, so it is stored instead
+	//of the BIP-174 non-witness UTXO.
+	Coin *tx.Coin
+	//PartialSigs maps a serialized pubkey to the signature a Signer made
+	//with the matching private key.
+	PartialSigs map[string][]byte
+	//RedeemScript is set when Coin is a P2SH output.
+	RedeemScript []byte
+}
+
+//Output carries the optional redeem script of an output, so the
+//Creator/Updater can mark a change output as going back to a P2SH
+//address the wallet controls.
+type Output struct {
+	RedeemScript []byte
+}
+
+//Psbt is a partially signed bitcoin transaction in progress.
+type Psbt struct {
+	UnsignedTx *msg.Tx
+	Inputs     []*Input
+	Outputs    []*Output
+}
+
+//New creates a PSBT (Creator+Updater) from an unsigned tx and the coins
+//being spent by its inputs. coins must be ordered the same as mtx.TxIn.
+func New(mtx *msg.Tx, coins []*tx.Coin) (*Psbt, error) {
+	if len(coins) != len(mtx.TxIn) {
+		return nil, errors.New("psbt: #coins must match #txin")
+	}
+	p := &Psbt{
+		UnsignedTx: mtx,
+		Inputs:     make([]*Input, len(mtx.TxIn)),
+		Outputs:    make([]*Output, len(mtx.TxOut)),
+	}
+	for i, c := range coins {
+		p.Inputs[i] = &Input{
+			Coin:        c,
+			PartialSigs: make(map[string][]byte),
+		}
+	}
+	for i := range mtx.TxOut {
+		p.Outputs[i] = &Output{}
+	}
+	return p, nil
+}
+
+//SetRedeemScript attaches a P2SH redeem script to input i, so Signers know
+//what to hash and Finalize knows how to build the scriptSig.
+func (p *Psbt) SetRedeemScript(i int, redeem []byte) error {
+	if i < 0 || i >= len(p.Inputs) {
+		return errors.New("psbt: input index out of range")
+	}
+	p.Inputs[i].RedeemScript = redeem
+	return nil
+}
+
+//Sign signs every input this wallet's priv can spend, adding the result to
+//PartialSigs so Combine/Finalize can assemble the final scriptSig. An
+//input matches either when Coin.Addr is priv's pubkey directly, or when
+//priv's pubkey is one of the input's P2SH RedeemScript's pubkeys.
+func (p *Psbt) Sign(priv *key.PrivateKey) error {
+	pub := priv.PublicKey()
+	signed := 0
+	for i, in := range p.Inputs {
+		if in.Coin == nil || !inputMatches(in, pub) {
+			continue
+		}
+		sig, err := priv.Sign(p.UnsignedTx, i, in.Coin)
+		if err != nil {
+			return fmt.Errorf("psbt: signing input %d: %s", i, err)
+		}
+		in.PartialSigs[string(pub.Serialize())] = sig
+		signed++
+	}
+	if signed == 0 {
+		return errors.New("psbt: no input matched this key")
+	}
+	return nil
+}
+
+//inputMatches reports whether pub can sign in, either directly (Coin.Addr
+//is pub) or as one of the cosigners of a P2SH RedeemScript.
+func inputMatches(in *Input, pub *key.PublicKey) bool {
+	a := pub.Serialize()
+	if bytes.Equal(in.Coin.Addr, a) {
+		return true
+	}
+	if len(in.RedeemScript) == 0 {
+		return false
+	}
+	rs, err := tx.ParseRedeemScript(in.RedeemScript)
+	if err != nil {
+		return false
+	}
+	for _, raw := range rs.Pubkeys {
+		if bytes.Equal(raw, a) {
+			return true
+		}
+	}
+	return false
+}
+
+//Combine merges the partial signatures of other into p. Both must wrap the
+//same unsigned transaction.
+func (p *Psbt) Combine(other *Psbt) error {
+	if !bytes.Equal(p.UnsignedTx.Hash(), other.UnsignedTx.Hash()) {
+		return errors.New("psbt: can't combine psbts of different txs")
+	}
+	if len(p.Inputs) != len(other.Inputs) {
+		return errors.New("psbt: input count mismatch")
+	}
+	for i, in := range other.Inputs {
+		if len(in.RedeemScript) > 0 && len(p.Inputs[i].RedeemScript) == 0 {
+			p.Inputs[i].RedeemScript = in.RedeemScript
+		}
+		for pub, sig := range in.PartialSigs {
+			p.Inputs[i].PartialSigs[pub] = sig
+		}
+	}
+	return nil
+}
+
+//Finalize builds the final scriptSig for every input from the collected
+//partial signatures and returns the broadcastable tx.
+func (p *Psbt) Finalize() (*msg.Tx, error) {
+	for i, in := range p.Inputs {
+		script, err := finalizeScript(in)
+		if err != nil {
+			return nil, fmt.Errorf("psbt: input %d: %s", i, err)
+		}
+		p.UnsignedTx.TxIn[i].Script = script
+	}
+	return p.UnsignedTx, nil
+}
+
+func finalizeScript(in *Input) ([]byte, error) {
+	if len(in.RedeemScript) > 0 {
+		return finalizeP2SH(in)
+	}
+	if len(in.PartialSigs) != 1 {
+		return nil, fmt.Errorf("expects exactly 1 signature, got %d", len(in.PartialSigs))
+	}
+	for pub, sig := range in.PartialSigs {
+		return buildScriptSig(sig, []byte(pub))
+	}
+	return nil, errors.New("unreachable")
+}
+
+//finalizeP2SH assembles a "<sig1>...<sigm> <redeemScript>" scriptSig
+//(the format tx.parseP2SHScriptsig expects), taking RedeemScript.M
+//signatures in the redeem script's pubkey order.
+func finalizeP2SH(in *Input) ([]byte, error) {
+	rs, err := tx.ParseRedeemScript(in.RedeemScript)
+	if err != nil {
+		return nil, err
+	}
+	var sigs [][]byte
+	for _, pub := range rs.Pubkeys {
+		sig, ok := in.PartialSigs[string(pub)]
+		if !ok {
+			continue
+		}
+		sigs = append(sigs, sig)
+		if len(sigs) == rs.M {
+			break
+		}
+	}
+	if len(sigs) != rs.M {
+		return nil, fmt.Errorf("expects %d signatures, got %d", rs.M, len(sigs))
+	}
+	buf := new(bytes.Buffer)
+	for _, sig := range sigs {
+		if err := pushBytes(buf, sig); err != nil {
+			return nil, err
+		}
+	}
+	if err := pushBytes(buf, in.RedeemScript); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//pushBytes writes b as a single-byte-length-prefixed chunk, the push
+//convention tx's scriptSig parsers use.
+func pushBytes(buf *bytes.Buffer, b []byte) error {
+	if len(b) > 255 {
+		return errors.New("psbt: script chunk too long to push")
+	}
+	if err := buf.WriteByte(byte(len(b))); err != nil {
+		return err
+	}
+	_, err := buf.Write(b)
+	return err
+}
+
+//buildScriptSig packs sig and pub into the scriptSig layout Add() already
+//knows how to parse (a DER signature followed by a SIGHASH_ALL byte, then
+//the pubkey).
+func buildScriptSig(sig, pub []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := msg.Pack(buf, sig); err != nil {
+		return nil, err
+	}
+	if err := msg.Pack(buf, byte(0x01)); err != nil {
+		return nil, err
+	}
+	if err := msg.Pack(buf, pub); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//Encode serializes p into the base64 PSBT format defined by BIP-174.
+func (p *Psbt) Encode() (string, error) {
+	buf := new(bytes.Buffer)
+	buf.Write(magic)
+
+	unsigned := new(bytes.Buffer)
+	if err := msg.Pack(unsigned, p.UnsignedTx); err != nil {
+		return "", err
+	}
+	if err := writeKV(buf, globalUnsignedTx, nil, unsigned.Bytes()); err != nil {
+		return "", err
+	}
+	buf.WriteByte(0x00)
+
+	for _, in := range p.Inputs {
+		if in.Coin != nil {
+			cb := new(bytes.Buffer)
+			if err := msg.Pack(cb, in.Coin); err != nil {
+				return "", err
+			}
+			if err := writeKV(buf, inNonWitnessUtxo, nil, cb.Bytes()); err != nil {
+				return "", err
+			}
+		}
+		if len(in.RedeemScript) > 0 {
+			if err := writeKV(buf, inRedeemScript, nil, in.RedeemScript); err != nil {
+				return "", err
+			}
+		}
+		for pub, sig := range in.PartialSigs {
+			if err := writeKV(buf, inPartialSig, []byte(pub), sig); err != nil {
+				return "", err
+			}
+		}
+		buf.WriteByte(0x00)
+	}
+
+	for _, out := range p.Outputs {
+		if len(out.RedeemScript) > 0 {
+			if err := writeKV(buf, outRedeemScript, nil, out.RedeemScript); err != nil {
+				return "", err
+			}
+		}
+		buf.WriteByte(0x00)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+//Decode parses a base64 PSBT string produced by Encode.
+func Decode(str string) (*Psbt, error) {
+	raw, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(raw)
+	if buf.Len() < len(magic) || !bytes.Equal(buf.Next(len(magic)), magic) {
+		return nil, errors.New("psbt: bad magic")
+	}
+
+	p := &Psbt{}
+	for {
+		keytype, keydata, val, end, err := readKV(buf)
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			break
+		}
+		if keytype == globalUnsignedTx && len(keydata) == 0 {
+			mtx := &msg.Tx{}
+			if err := msg.Unpack(bytes.NewBuffer(val), mtx); err != nil {
+				return nil, err
+			}
+			p.UnsignedTx = mtx
+		}
+	}
+	if p.UnsignedTx == nil {
+		return nil, errors.New("psbt: missing unsigned tx")
+	}
+	p.Inputs = make([]*Input, len(p.UnsignedTx.TxIn))
+	for i := range p.Inputs {
+		in := &Input{PartialSigs: make(map[string][]byte)}
+		for {
+			keytype, keydata, val, end, err := readKV(buf)
+			if err != nil {
+				return nil, err
+			}
+			if end {
+				break
+			}
+			switch keytype {
+			case inNonWitnessUtxo:
+				c := &tx.Coin{}
+				if err := msg.Unpack(bytes.NewBuffer(val), c); err != nil {
+					return nil, err
+				}
+				in.Coin = c
+			case inRedeemScript:
+				in.RedeemScript = val
+			case inPartialSig:
+				in.PartialSigs[string(keydata)] = val
+			}
+		}
+		p.Inputs[i] = in
+	}
+	p.Outputs = make([]*Output, len(p.UnsignedTx.TxOut))
+	for i := range p.Outputs {
+		out := &Output{}
+		for {
+			keytype, _, val, end, err := readKV(buf)
+			if err != nil {
+				return nil, err
+			}
+			if end {
+				break
+			}
+			if keytype == outRedeemScript {
+				out.RedeemScript = val
+			}
+		}
+		p.Outputs[i] = out
+	}
+	return p, nil
+}
+
+//writeKV writes one BIP-174 key-value pair: <len><type><keydata> <len><value>.
+func writeKV(buf *bytes.Buffer, keytype byte, keydata, val []byte) error {
+	key := append([]byte{keytype}, keydata...)
+	if err := writeVarBytes(buf, key); err != nil {
+		return err
+	}
+	return writeVarBytes(buf, val)
+}
+
+//readKV reads one key-value pair, or reports end==true at a 0x00 map
+//terminator.
+func readKV(buf *bytes.Buffer) (keytype byte, keydata, val []byte, end bool, err error) {
+	key, err := readVarBytes(buf)
+	if err != nil {
+		return 0, nil, nil, false, err
+	}
+	if len(key) == 0 {
+		return 0, nil, nil, true, nil
+	}
+	val, err = readVarBytes(buf)
+	if err != nil {
+		return 0, nil, nil, false, err
+	}
+	return key[0], key[1:], val, false, nil
+}
+
+func writeVarBytes(buf *bytes.Buffer, b []byte) error {
+	if err := writeVarInt(buf, uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := buf.Write(b)
+	return err
+}
+
+func readVarBytes(buf *bytes.Buffer) ([]byte, error) {
+	n, err := readVarInt(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return []byte{}, nil
+	}
+	b := buf.Next(int(n))
+	if uint64(len(b)) != n {
+		return nil, errors.New("psbt: truncated data")
+	}
+	return b, nil
+}
+
+//writeVarInt writes n as a bitcoin compact size integer.
+func writeVarInt(buf *bytes.Buffer, n uint64) error {
+	switch {
+	case n < 0xfd:
+		return buf.WriteByte(byte(n))
+	case n <= 0xffff:
+		if err := buf.WriteByte(0xfd); err != nil {
+			return err
+		}
+		return msg.Pack(buf, uint16(n))
+	case n <= 0xffffffff:
+		if err := buf.WriteByte(0xfe); err != nil {
+			return err
+		}
+		return msg.Pack(buf, uint32(n))
+	default:
+		if err := buf.WriteByte(0xff); err != nil {
+			return err
+		}
+		return msg.Pack(buf, n)
+	}
+}
+
+//readVarInt reads a bitcoin compact size integer.
+func readVarInt(buf *bytes.Buffer) (uint64, error) {
+	b, err := buf.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch b {
+	case 0xfd:
+		var v uint16
+		if err := msg.Unpack(buf, &v); err != nil {
+			return 0, err
+		}
+		return uint64(v), nil
+	case 0xfe:
+		var v uint32
+		if err := msg.Unpack(buf, &v); err != nil {
+			return 0, err
+		}
+		return uint64(v), nil
+	case 0xff:
+		var v uint64
+		if err := msg.Unpack(buf, &v); err != nil {
+			return 0, err
+		}
+		return v, nil
+	default:
+		return uint64(b), nil
+	}
+}
+
+//Save persists a draft PSBT so a multisig ceremony can resume after a
+//restart, keyed by the hash of its unsigned tx.
+func Save(p *Psbt) error {
+	str, err := p.Encode()
+	if err != nil {
+		return err
+	}
+	return db.Batch(bucket, p.UnsignedTx.Hash(), str)
+}
+
+//Load loads a draft PSBT previously stored by Save.
+func Load(hash []byte) (*Psbt, error) {
+	var str string
+	err := db.DB.View(func(t *bolt.Tx) error {
+		_, err := db.Get(t, bucket, hash, &str)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Decode(str)
+}
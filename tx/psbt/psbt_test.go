@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package psbt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/monarj/wallet/msg"
+)
+
+//buildRedeemScript builds a raw "OP_m <pub1>...<pubn> OP_n OP_CHECKMULTISIG"
+//redeem script, the format tx.ParseRedeemScript expects.
+func buildRedeemScript(m int, pubkeys [][]byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(0x50 + m))
+	for _, pub := range pubkeys {
+		buf.WriteByte(byte(len(pub)))
+		buf.Write(pub)
+	}
+	buf.WriteByte(byte(0x50 + len(pubkeys)))
+	buf.WriteByte(0xae)
+	return buf.Bytes()
+}
+
+func TestFinalizeP2SHOrdersSigsByPubkey(t *testing.T) {
+	pub1 := []byte("pub1pub1pub1pub1pub1")
+	pub2 := []byte("pub2pub2pub2pub2pub2")
+	pub3 := []byte("pub3pub3pub3pub3pub3")
+	redeem := buildRedeemScript(2, [][]byte{pub1, pub2, pub3})
+
+	in := &Input{
+		RedeemScript: redeem,
+		PartialSigs: map[string][]byte{
+			string(pub3): []byte("sig3"),
+			string(pub1): []byte("sig1"),
+		},
+	}
+	script, err := finalizeScript(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := new(bytes.Buffer)
+	want.WriteByte(byte(len("sig1")))
+	want.WriteString("sig1")
+	want.WriteByte(byte(len("sig3")))
+	want.WriteString("sig3")
+	want.WriteByte(byte(len(redeem)))
+	want.Write(redeem)
+	if !bytes.Equal(script, want.Bytes()) {
+		t.Fatalf("got %x, want %x", script, want.Bytes())
+	}
+}
+
+func TestFinalizeP2SHTooFewSigs(t *testing.T) {
+	pub1 := []byte("pub1pub1pub1pub1pub1")
+	pub2 := []byte("pub2pub2pub2pub2pub2")
+	redeem := buildRedeemScript(2, [][]byte{pub1, pub2})
+
+	in := &Input{
+		RedeemScript: redeem,
+		PartialSigs:  map[string][]byte{string(pub1): []byte("sig1")},
+	}
+	if _, err := finalizeScript(in); err == nil {
+		t.Fatal("expected an error when fewer than M signatures are present")
+	}
+}
+
+func TestFinalizeScriptP2PKHWrongSigCount(t *testing.T) {
+	in := &Input{
+		PartialSigs: map[string][]byte{
+			"pubA": []byte("sigA"),
+			"pubB": []byte("sigB"),
+		},
+	}
+	if _, err := finalizeScript(in); err == nil {
+		t.Fatal("expected an error for a non-P2SH input with more than one partial sig")
+	}
+}
+
+func TestCombineMergesSigsAndRedeemScript(t *testing.T) {
+	mtx := &msg.Tx{}
+	a := &Psbt{
+		UnsignedTx: mtx,
+		Inputs: []*Input{
+			{PartialSigs: map[string][]byte{"pubA": []byte("sigA")}},
+		},
+	}
+	b := &Psbt{
+		UnsignedTx: mtx,
+		Inputs: []*Input{
+			{
+				PartialSigs:  map[string][]byte{"pubB": []byte("sigB")},
+				RedeemScript: []byte{0x52},
+			},
+		},
+	}
+	if err := a.Combine(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Inputs[0].PartialSigs) != 2 {
+		t.Fatalf("expected 2 partial sigs after combine, got %d", len(a.Inputs[0].PartialSigs))
+	}
+	if !bytes.Equal(a.Inputs[0].RedeemScript, []byte{0x52}) {
+		t.Fatal("expected a's missing redeem script to be picked up from b")
+	}
+}
+
+func TestCombineRejectsDifferentTxs(t *testing.T) {
+	a := &Psbt{
+		UnsignedTx: &msg.Tx{TxOut: []msg.TxOut{{Value: 1}}},
+		Inputs:     []*Input{{PartialSigs: map[string][]byte{}}},
+	}
+	b := &Psbt{
+		UnsignedTx: &msg.Tx{TxOut: []msg.TxOut{{Value: 2}}},
+		Inputs:     []*Input{{PartialSigs: map[string][]byte{}}},
+	}
+	if err := a.Combine(b); err == nil {
+		t.Fatal("expected Combine to reject psbts wrapping different unsigned txs")
+	}
+}
@@ -35,9 +35,13 @@ import (
 
 	"bytes"
 
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 
+	"github.com/boltdb/bolt"
 	"github.com/monarj/wallet/behex"
+	"github.com/monarj/wallet/db"
 	"github.com/monarj/wallet/key"
 	"github.com/monarj/wallet/msg"
 )
@@ -72,6 +76,71 @@ type Coin struct {
 	TxIndex uint32
 	Value   uint64
 	Ttype   int
+	//RedeemScript is set when this coin is a P2SH (Ttype=2) multisig output.
+	RedeemScript []byte `len:"var"`
+}
+
+//MarshalDB implements db.Marshaler, encoding a Coin in the wallet's
+//compact wire-style format instead of JSON.
+func (c *Coin) MarshalDB() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := msg.Pack(buf, c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//UnmarshalDB implements db.Unmarshaler.
+func (c *Coin) UnmarshalDB(data []byte) error {
+	return msg.Unpack(bytes.NewBuffer(data), c)
+}
+
+//coinJSON is Coin's JSON representation, hex-encoding its byte fields so
+//wallet/api responses agree with each other (list-addresses and
+//list-transactions already hex-encode, and coinsByAddress hex-decodes the
+//address it's given). Only Marshal is implemented: json.Unmarshal of a
+//legacy (pre-MigrateCoinsToBinary) DB entry relies on Coin's default,
+//base64-based decoding, which this must not disturb.
+type coinJSON struct {
+	Addr         string `json:"addr"`
+	TxHash       string `json:"tx_hash"`
+	TxIndex      uint32 `json:"tx_index"`
+	Value        uint64 `json:"value"`
+	Ttype        int    `json:"ttype"`
+	RedeemScript string `json:"redeem_script,omitempty"`
+}
+
+//MarshalJSON implements json.Marshaler.
+func (c *Coin) MarshalJSON() ([]byte, error) {
+	return json.Marshal(coinJSON{
+		Addr:         hex.EncodeToString(c.Addr),
+		TxHash:       hex.EncodeToString(c.TxHash),
+		TxIndex:      c.TxIndex,
+		Value:        c.Value,
+		Ttype:        c.Ttype,
+		RedeemScript: hex.EncodeToString(c.RedeemScript),
+	})
+}
+
+//MigrateCoinsToBinary re-encodes every JSON-encoded Coin in the coin
+//bucket into its compact MarshalDB form and stamps schemaVersion. It's
+//safe to run more than once: an entry already in binary form (it won't
+//start with '{') is left as-is instead of being force-fed to
+//json.Unmarshal, so it's just rewritten to the same bytes.
+func MigrateCoinsToBinary() error {
+	return db.MigrateToBinary(coinBucket, func(raw []byte) (db.Marshaler, error) {
+		c := &Coin{}
+		if len(raw) == 0 || raw[0] != '{' {
+			if err := c.UnmarshalDB(raw); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+		if err := json.Unmarshal(raw, c); err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
 }
 
 func add(pub *key.PublicKey, tx *msg.Tx, index uint32, ttype int) {
@@ -118,6 +187,17 @@ type ScriptSigH struct {
 	S         []byte `len:"var"`
 }
 
+//MarshalDB implements db.Marshaler using the same msg.Pack layout the
+//wire protocol uses to parse a scriptSig.
+func (s *ScriptSigH) MarshalDB() ([]byte, error) {
+	return packDB(s)
+}
+
+//UnmarshalDB implements db.Unmarshaler.
+func (s *ScriptSigH) UnmarshalDB(data []byte) error {
+	return msg.Unpack(bytes.NewBuffer(data), s)
+}
+
 //ScriptSigT is the tail of  scriptsig this program supports.
 type ScriptSigT struct {
 	Postfix01 byte
@@ -125,6 +205,16 @@ type ScriptSigT struct {
 	Pubkey    []byte `len:"var"`
 }
 
+//MarshalDB implements db.Marshaler.
+func (s *ScriptSigT) MarshalDB() ([]byte, error) {
+	return packDB(s)
+}
+
+//UnmarshalDB implements db.Unmarshaler.
+func (s *ScriptSigT) UnmarshalDB(data []byte) error {
+	return msg.Unpack(bytes.NewBuffer(data), s)
+}
+
 //Script the default out scrip this program supports.
 type Script struct {
 	Dup         byte
@@ -135,6 +225,16 @@ type Script struct {
 	CheckSig    byte
 }
 
+//MarshalDB implements db.Marshaler.
+func (s *Script) MarshalDB() ([]byte, error) {
+	return packDB(s)
+}
+
+//UnmarshalDB implements db.Unmarshaler.
+func (s *Script) UnmarshalDB(data []byte) error {
+	return msg.Unpack(bytes.NewBuffer(data), s)
+}
+
 //Script2 is anotther out scrip this program supports.
 type Script2 struct {
 	Length   byte
@@ -142,6 +242,175 @@ type Script2 struct {
 	CheckSig byte
 }
 
+//MarshalDB implements db.Marshaler.
+func (s *Script2) MarshalDB() ([]byte, error) {
+	return packDB(s)
+}
+
+//UnmarshalDB implements db.Unmarshaler.
+func (s *Script2) UnmarshalDB(data []byte) error {
+	return msg.Unpack(bytes.NewBuffer(data), s)
+}
+
+//Script3 is a BIP-16 P2SH out script: OP_HASH160 <20 byte hash> OP_EQUAL.
+type Script3 struct {
+	Hash160    byte
+	HashLength byte
+	ScriptHash []byte `len:"20"`
+	Equal      byte
+}
+
+//MarshalDB implements db.Marshaler.
+func (s *Script3) MarshalDB() ([]byte, error) {
+	return packDB(s)
+}
+
+//UnmarshalDB implements db.Unmarshaler.
+func (s *Script3) UnmarshalDB(data []byte) error {
+	return msg.Unpack(bytes.NewBuffer(data), s)
+}
+
+//packDB is the shared msg.Pack-based MarshalDB body for this package's
+//fixed-layout script structs.
+func packDB(s interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := msg.Pack(buf, s); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//redeemBucket stores known redeem scripts keyed by their script hash, so
+//a P2SH scriptSig the wallet co-signs can be recognized.
+const redeemBucket = "redeem"
+
+//RedeemScript is a parsed "m <pub1>...<pubn> n OP_CHECKMULTISIG" redeem
+//script of the kind a P2SH (Script3) output hashes.
+type RedeemScript struct {
+	M       int
+	Pubkeys [][]byte
+	N       int
+}
+
+//MarshalDB implements db.Marshaler. M/N fit in a byte and Pubkeys is
+//variable length, so this is packed by hand instead of via msg.Pack:
+//<M byte><N byte><pubkey0 len+bytes>...<pubkeyN-1 len+bytes>.
+func (r *RedeemScript) MarshalDB() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(r.M))
+	buf.WriteByte(byte(r.N))
+	for _, pub := range r.Pubkeys {
+		if len(pub) > 255 {
+			return nil, errors.New("redeem script: pubkey too long")
+		}
+		buf.WriteByte(byte(len(pub)))
+		buf.Write(pub)
+	}
+	return buf.Bytes(), nil
+}
+
+//UnmarshalDB implements db.Unmarshaler.
+func (r *RedeemScript) UnmarshalDB(data []byte) error {
+	if len(data) < 2 {
+		return errors.New("redeem script: too short")
+	}
+	r.M = int(data[0])
+	r.N = int(data[1])
+	rest := data[2:]
+	r.Pubkeys = nil
+	for len(rest) > 0 {
+		l := int(rest[0])
+		if len(rest) < 1+l {
+			return errors.New("redeem script: truncated pubkey")
+		}
+		r.Pubkeys = append(r.Pubkeys, rest[1:1+l])
+		rest = rest[1+l:]
+	}
+	if len(r.Pubkeys) != r.N {
+		return errors.New("redeem script: n doesn't match pubkey count")
+	}
+	return nil
+}
+
+//opToN converts an OP_1..OP_16 opcode to its integer value.
+func opToN(op byte) (int, bool) {
+	if op < 0x51 || op > 0x60 {
+		return 0, false
+	}
+	return int(op) - 0x50, true
+}
+
+//ParseRedeemScript parses the raw bytes of a "m-of-n" multisig redeem
+//script.
+func ParseRedeemScript(data []byte) (*RedeemScript, error) {
+	if len(data) < 3 {
+		return nil, errors.New("redeem script is too short")
+	}
+	m, ok := opToN(data[0])
+	if !ok {
+		return nil, errors.New("redeem script doesn't start with OP_m")
+	}
+	rest := data[1:]
+	var pubkeys [][]byte
+	for len(rest) > 0 && rest[0] < 0x51 {
+		l := int(rest[0])
+		if len(rest) < 1+l {
+			return nil, errors.New("malformed redeem script")
+		}
+		pubkeys = append(pubkeys, rest[1:1+l])
+		rest = rest[1+l:]
+	}
+	if len(rest) != 2 {
+		return nil, errors.New("malformed redeem script")
+	}
+	n, ok := opToN(rest[0])
+	if !ok {
+		return nil, errors.New("redeem script doesn't have OP_n")
+	}
+	if rest[1] != opCHECKMULTISIG {
+		return nil, errors.New("redeem script doesn't end with OP_CHECKMULTISIG")
+	}
+	if n != len(pubkeys) || n < m {
+		return nil, errors.New("m/n doesn't match pubkey count")
+	}
+	return &RedeemScript{M: m, Pubkeys: pubkeys, N: n}, nil
+}
+
+//parseP2SHScriptsig parses a P2SH scriptSig of the form
+//"<sig1>...<sigm> <redeemScript>" and returns its redeem script and
+//signatures.
+func parseP2SHScriptsig(data []byte) (*RedeemScript, [][]byte, error) {
+	buf := bytes.NewBuffer(data)
+	var sigs [][]byte
+	var redeem []byte
+	for buf.Len() > 0 {
+		l, err := buf.ReadByte()
+		if err != nil {
+			return nil, nil, errors.New("malformed p2sh scriptsig")
+		}
+		chunk := buf.Next(int(l))
+		if len(chunk) != int(l) {
+			return nil, nil, errors.New("malformed p2sh scriptsig")
+		}
+		if buf.Len() == 0 {
+			redeem = chunk
+			break
+		}
+		sigs = append(sigs, chunk)
+	}
+	if redeem == nil {
+		return nil, nil, errors.New("p2sh scriptsig has no redeem script")
+	}
+	rs, err := ParseRedeemScript(redeem)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sigs) != rs.M {
+		return nil, nil, fmt.Errorf("expects %d signatures, got %d", rs.M, len(sigs))
+	}
+	return rs, sigs, nil
+}
+
 func parse(s interface{}, data []byte) error {
 	buf := bytes.NewBuffer(data)
 	if err := msg.Unpack(buf, s); err != nil {
@@ -194,6 +463,16 @@ func Add(mtx *msg.Tx) error {
 		}
 		buf, err := parseScriptsigH(in.Script)
 		if err != nil {
+			if rs, _, perr := parseP2SHScriptsig(in.Script); perr == nil {
+				if verr := verifyRedeemKeys(rs); verr != nil {
+					log.Println(verr)
+					continue
+				}
+				if err := removeRedeem(in.Hash, in.Index); err != nil {
+					log.Println(err)
+				}
+				continue
+			}
 			log.Println(err)
 			continue
 		}
@@ -216,6 +495,8 @@ func Add(mtx *msg.Tx) error {
 		err := parse(&s, in.Script)
 		s2 := Script2{}
 		err2 := parse(&s2, in.Script)
+		s3 := Script3{}
+		err4 := parse(&s3, in.Script)
 
 		var pubkey *key.PublicKey
 		var err3 error
@@ -229,8 +510,17 @@ func Add(mtx *msg.Tx) error {
 			log.Println("pubkey scriptsig")
 			pubkey, err3 = checkTxout2(&s2)
 			ttype = 1
+		case err4 == nil:
+			log.Println("p2sh scriptsig")
+			redeem, rerr := checkTxout3(&s3)
+			if rerr != nil {
+				log.Println(rerr, behex.EncodeToString(mtx.Hash()))
+				continue
+			}
+			addWithRedeem(s3.ScriptHash, mtx, uint32(i), redeem)
+			continue
 		default:
-			log.Println(err, err2)
+			log.Println(err, err2, err4)
 			err3 = fmt.Errorf("This txout is not supproted")
 		}
 		if err3 != nil {
@@ -291,3 +581,91 @@ func checkTxout2(s *Script2) (*key.PublicKey, error) {
 	}
 	return pubkey, nil
 }
+
+func checkTxout3(s *Script3) ([]byte, error) {
+	switch {
+	case s.Hash160 != opHASH160:
+		fallthrough
+	case s.HashLength != 0x14:
+		fallthrough
+	case s.Equal != opEQUAL:
+		return nil, errors.New("unsuported scriptsig")
+	}
+	redeem, has := key.HasScriptHash(s.ScriptHash)
+	if !has {
+		return nil, errors.New("not concerened script hash")
+	}
+	return redeem, nil
+}
+
+//verifyRedeemKeys makes sure at least one pubkey of a redeem script is
+//one of ours, the same relation checkTxin requires for plain P2PKH spends.
+func verifyRedeemKeys(rs *RedeemScript) error {
+	for _, raw := range rs.Pubkeys {
+		pubkey, err := key.NewPublicKey(raw)
+		if err != nil {
+			continue
+		}
+		if key.HasPubkey(pubkey) {
+			return nil
+		}
+	}
+	return errors.New("not concerened redeem script")
+}
+
+//addWithRedeem adds a P2SH multisig coin, keyed by its script hash since
+//it isn't owned by a single pubkey.
+func addWithRedeem(scriptHash []byte, mtx *msg.Tx, index uint32, redeem []byte) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	c := &Coin{
+		Addr:         scriptHash,
+		TxHash:       mtx.Hash(),
+		TxIndex:      index,
+		Value:        mtx.TxOut[index].Value,
+		Ttype:        2,
+		RedeemScript: redeem,
+	}
+	coins[string(scriptHash)] = append(coins[string(scriptHash)], c)
+}
+
+//removeRedeem removes a spent P2SH multisig coin, found by its tx
+//hash/index rather than by owning pubkey.
+func removeRedeem(hash []byte, index uint32) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for addr, coin := range coins {
+		for i, c := range coin {
+			if c.Ttype != 2 || !bytes.Equal(c.TxHash, hash) || c.TxIndex != index {
+				continue
+			}
+			coin[i] = coin[len(coin)-1]
+			coin[len(coin)-1] = nil
+			coin = coin[:len(coin)-1]
+			coins[addr] = coin
+			return nil
+		}
+	}
+	return errors.New("coin was not found")
+}
+
+//SaveRedeemScript remembers redeem under its script hash so a P2SH output
+//paying it is later recognized by checkTxout3/key.HasScriptHash.
+func SaveRedeemScript(scriptHash, redeem []byte) error {
+	return db.Batch(redeemBucket, scriptHash, redeem)
+}
+
+//GetRedeemScript looks up the raw redeem script previously saved under
+//scriptHash by SaveRedeemScript, e.g. to re-export it for a multisig ceremony.
+func GetRedeemScript(scriptHash []byte) ([]byte, error) {
+	var redeem []byte
+	err := db.DB.View(func(t *bolt.Tx) error {
+		v, err := db.Get(t, redeemBucket, scriptHash, nil)
+		if err != nil {
+			return err
+		}
+		redeem = v
+		return nil
+	})
+	return redeem, err
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+//Package api exposes read-only HTTP endpoints for querying the wallet's
+//bolt database directly, without going through the p2p or RPC layers.
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/monarj/wallet/db"
+	"github.com/monarj/wallet/tx"
+)
+
+//response is the uniform envelope every endpoint replies with.
+type response struct {
+	Status string      `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+	Msg    string      `json:"msg,omitempty"`
+}
+
+func writeSuccess(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response{Status: "success", Data: data})
+}
+
+func writeFail(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response{Status: "fail", Msg: err.Error()})
+}
+
+//blockHeader is the (height,prev) value stored in the "block" bucket.
+type blockHeader struct {
+	Height int64
+	Prev   []byte
+}
+
+//RegisterHandlers wires the wallet's query endpoints into mux.
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/list-utxos", listUtxos)
+	mux.HandleFunc("/get-balance", getBalance)
+	mux.HandleFunc("/list-addresses", listAddresses)
+	mux.HandleFunc("/get-block-header", getBlockHeader)
+	mux.HandleFunc("/list-transactions", listTransactions)
+}
+
+//Start registers the query endpoints and begins serving at addr.
+func Start(addr string) error {
+	mux := http.NewServeMux()
+	RegisterHandlers(mux)
+	return http.ListenAndServe(addr, mux)
+}
+
+type addressReq struct {
+	Address string `json:"address"`
+}
+
+//coinsByAddress returns every coin in the coin bucket, optionally filtered
+//to those belonging to address, which is the hex encoding produced by
+//listAddresses (and list-utxos/get-balance/list-transactions accept back).
+func coinsByAddress(t *bolt.Tx, address string) ([]*tx.Coin, error) {
+	var addr []byte
+	if address != "" {
+		var err error
+		addr, err = hex.DecodeString(address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	keys, err := db.KeyStrings(t, "coin")
+	if err != nil {
+		return nil, err
+	}
+	var coins []*tx.Coin
+	for _, k := range keys {
+		c := &tx.Coin{}
+		if _, err := db.Get(t, "coin", []byte(k), c); err != nil {
+			return nil, err
+		}
+		if addr != nil && !bytes.Equal(c.Addr, addr) {
+			continue
+		}
+		coins = append(coins, c)
+	}
+	return coins, nil
+}
+
+func listUtxos(w http.ResponseWriter, r *http.Request) {
+	var req addressReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFail(w, err)
+		return
+	}
+	var coins []*tx.Coin
+	err := db.DB.View(func(t *bolt.Tx) error {
+		var err error
+		coins, err = coinsByAddress(t, req.Address)
+		return err
+	})
+	if err != nil {
+		writeFail(w, err)
+		return
+	}
+	writeSuccess(w, coins)
+}
+
+func getBalance(w http.ResponseWriter, r *http.Request) {
+	var req addressReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFail(w, err)
+		return
+	}
+	var balance uint64
+	err := db.DB.View(func(t *bolt.Tx) error {
+		coins, err := coinsByAddress(t, req.Address)
+		if err != nil {
+			return err
+		}
+		for _, c := range coins {
+			balance += c.Value
+		}
+		return nil
+	})
+	if err != nil {
+		writeFail(w, err)
+		return
+	}
+	writeSuccess(w, balance)
+}
+
+func listAddresses(w http.ResponseWriter, r *http.Request) {
+	var addrs []string
+	err := db.DB.View(func(t *bolt.Tx) error {
+		keys, err := db.KeyStrings(t, "key")
+		if err != nil {
+			return err
+		}
+		addrs = make([]string, len(keys))
+		for i, k := range keys {
+			addrs[i] = hex.EncodeToString([]byte(k))
+		}
+		return nil
+	})
+	if err != nil {
+		writeFail(w, err)
+		return
+	}
+	writeSuccess(w, addrs)
+}
+
+func getBlockHeader(w http.ResponseWriter, r *http.Request) {
+	height, err := strconv.ParseInt(r.URL.Query().Get("height"), 10, 64)
+	if err != nil {
+		writeFail(w, err)
+		return
+	}
+	var header blockHeader
+	err = db.DB.View(func(t *bolt.Tx) error {
+		var hash []byte
+		if _, err := db.Get(t, "blockheight", db.ToKey(height), &hash); err != nil {
+			return err
+		}
+		_, err := db.Get(t, "block", hash, &header)
+		return err
+	})
+	if err != nil {
+		writeFail(w, err)
+		return
+	}
+	writeSuccess(w, header)
+}
+
+func listTransactions(w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Query().Get("address")
+	var coins []*tx.Coin
+	err := db.DB.View(func(t *bolt.Tx) error {
+		var err error
+		coins, err = coinsByAddress(t, address)
+		return err
+	})
+	if err != nil {
+		writeFail(w, err)
+		return
+	}
+	hashes := make([]string, 0, len(coins))
+	seen := make(map[string]struct{})
+	for _, c := range coins {
+		h := string(c.TxHash)
+		if _, ok := seen[h]; ok {
+			continue
+		}
+		seen[h] = struct{}{}
+		hashes = append(hashes, hex.EncodeToString(c.TxHash))
+	}
+	writeSuccess(w, hashes)
+}